@@ -0,0 +1,98 @@
+package dockertest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// defaultRegistry is the server address docker resolves bare image
+// names (e.g. "mysql") against.
+const defaultRegistry = "https://index.docker.io/v1/"
+
+// dockerConfig mirrors the handful of fields of ~/.docker/config.json
+// this package cares about.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth string `json:"auth"`
+	} `json:"auths"`
+}
+
+// resolveAuth looks up credentials for image's registry in
+// ~/.docker/config.json, mirroring how the docker CLI resolves
+// credentials when no explicit auth is given. It returns the zero
+// value, with no error, if none are configured there; pulling public
+// images doesn't require auth.
+func resolveAuth(image string) (types.AuthConfig, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return types.AuthConfig{}, nil
+	}
+	data, err := os.ReadFile(filepath.Join(home, ".docker", "config.json"))
+	if err != nil {
+		return types.AuthConfig{}, nil
+	}
+	var cfg dockerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return types.AuthConfig{}, fmt.Errorf("dockertest: parsing ~/.docker/config.json: %v", err)
+	}
+	registry := registryForImage(image)
+	entry, ok := cfg.Auths[registry]
+	if !ok || entry.Auth == "" {
+		return types.AuthConfig{}, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+	if err != nil {
+		return types.AuthConfig{}, fmt.Errorf("dockertest: decoding credentials for %s: %v", registry, err)
+	}
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return types.AuthConfig{}, fmt.Errorf("dockertest: malformed credentials for %s", registry)
+	}
+	return types.AuthConfig{Username: user, Password: pass, ServerAddress: registry}, nil
+}
+
+// registryForImage returns the registry host a reference like
+// "myregistry.example.com:5000/foo/bar:baz" or "gcr.io/my-project/my-image"
+// resolves against, defaulting to Docker Hub. Only the first path
+// segment can ever be a registry host, matching how docker itself
+// splits a reference's domain from its repository path.
+func registryForImage(image string) string {
+	ref := image
+	if i := strings.LastIndex(ref, "@"); i != -1 {
+		ref = ref[:i]
+	}
+	if i := strings.IndexRune(ref, '/'); i != -1 {
+		host := ref[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			return host
+		}
+	}
+	return defaultRegistry
+}
+
+// encodeAuth base64-encodes auth the way the Engine API expects it in
+// the X-Registry-Auth header (types.ImagePullOptions.RegistryAuth).
+func encodeAuth(auth types.AuthConfig) (string, error) {
+	buf, err := json.Marshal(auth)
+	if err != nil {
+		return "", fmt.Errorf("dockertest: encoding registry auth: %v", err)
+	}
+	return base64.URLEncoding.EncodeToString(buf), nil
+}
+
+// PullWithAuth retrieves image using the given registry credentials,
+// for private registries or mirrors (ECR, GCR, ...) that ~/.docker/config.json
+// doesn't already cover.
+func PullWithAuth(image string, auth types.AuthConfig) error {
+	c, err := defaultClientOrDial()
+	if err != nil {
+		return err
+	}
+	return c.pullAuth(image, auth)
+}
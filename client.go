@@ -0,0 +1,199 @@
+package dockertest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+)
+
+// Client wraps the Docker Engine API and dials the daemon lazily, so that
+// merely importing this package never requires a running daemon. It
+// honors the same DOCKER_HOST, DOCKER_TLS_VERIFY and DOCKER_CERT_PATH
+// environment variables as the docker CLI, via client.FromEnv.
+type Client struct {
+	cli *client.Client
+}
+
+// defaultClient is dialed on first use by the package-level helper
+// functions below, so existing callers don't need to thread a *Client
+// through their own code.
+var (
+	defaultClient     *Client
+	defaultClientOnce sync.Once
+	defaultClientErr  error
+)
+
+// newClient dials the docker daemon referenced by the environment.
+func newClient() (*Client, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("dockertest: dialing docker daemon: %v", err)
+	}
+	return &Client{cli: cli}, nil
+}
+
+// defaultClientOrDial returns the shared default Client, dialing it on
+// first use.
+func defaultClientOrDial() (*Client, error) {
+	defaultClientOnce.Do(func() {
+		defaultClient, defaultClientErr = newClient()
+	})
+	return defaultClient, defaultClientErr
+}
+
+// runSpec describes a container to start.
+type runSpec struct {
+	Image string
+	Env   []string
+	Cmd   []string
+	// ExposedPorts are published on the host. Unless overridden by a
+	// matching entry in PortBindings, the daemon picks a free host
+	// port for each one. If both ExposedPorts and PortBindings are
+	// empty, every port the image itself exposes is published instead
+	// (equivalent to "docker run -P").
+	ExposedPorts []string
+	PortBindings map[nat.Port][]nat.PortBinding
+	// Tmpfs mounts paths inside the container on tmpfs, keyed by
+	// mount path with docker's tmpfs mount options as the value (e.g.
+	// "" or "rw,noexec,size=64m").
+	Tmpfs map[string]string
+	// Labels are applied to the container as-is; Pool uses this to tag
+	// every container it starts with the session label the reaper
+	// watches for.
+	Labels map[string]string
+	// Binds are bind-mounts in docker's "host:container[:opts]"
+	// syntax; the reaper uses this to give the ryuk container access
+	// to the daemon socket.
+	Binds []string
+}
+
+func (c *Client) haveImage(name string) (bool, error) {
+	images, err := c.cli.ImageList(context.Background(), types.ImageListOptions{})
+	if err != nil {
+		return false, fmt.Errorf("dockertest: listing images: %v", err)
+	}
+	// An untagged name refers to its "latest" tag, as it does for the
+	// daemon when the container is created.
+	want := name
+	if !strings.Contains(name[strings.LastIndex(name, "/")+1:], ":") {
+		want = name + ":latest"
+	}
+	for _, img := range images {
+		for _, tag := range img.RepoTags {
+			if tag == want {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// pull retrieves image, resolving credentials from ~/.docker/config.json
+// if the registry requires them.
+func (c *Client) pull(image string) error {
+	auth, err := resolveAuth(image)
+	if err != nil {
+		return err
+	}
+	return c.pullAuth(image, auth)
+}
+
+// pullAuth retrieves image using the given registry credentials. The
+// zero value of types.AuthConfig pulls anonymously.
+func (c *Client) pullAuth(image string, auth types.AuthConfig) error {
+	ctx := context.Background()
+	opts := types.ImagePullOptions{}
+	if auth != (types.AuthConfig{}) {
+		encoded, err := encodeAuth(auth)
+		if err != nil {
+			return err
+		}
+		opts.RegistryAuth = encoded
+	}
+	rc, err := c.cli.ImagePull(ctx, image, opts)
+	if err != nil {
+		return fmt.Errorf("dockertest: pulling %s: %v", image, err)
+	}
+	defer rc.Close()
+	// Drain the progress stream; callers only care whether the pull
+	// succeeded, not the output.
+	buf := make([]byte, 32*1024)
+	for {
+		if _, err := rc.Read(buf); err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (c *Client) run(spec runSpec) (containerID string, err error) {
+	ctx := context.Background()
+	config := &container.Config{
+		Image:  spec.Image,
+		Env:    spec.Env,
+		Cmd:    spec.Cmd,
+		Labels: spec.Labels,
+	}
+	hostConfig := &container.HostConfig{PortBindings: make(nat.PortMap)}
+	if len(spec.ExposedPorts) > 0 {
+		exposed, bindings, err := nat.ParsePortSpecs(spec.ExposedPorts)
+		if err != nil {
+			return "", fmt.Errorf("dockertest: parsing exposed ports: %v", err)
+		}
+		config.ExposedPorts = exposed
+		for port, binding := range bindings {
+			hostConfig.PortBindings[port] = binding
+		}
+	}
+	for port, bindings := range spec.PortBindings {
+		hostConfig.PortBindings[port] = bindings
+	}
+	if len(spec.ExposedPorts) == 0 && len(spec.PortBindings) == 0 {
+		// Nothing was asked for explicitly; publish whatever the image
+		// itself exposes, equivalent to "docker run -P".
+		hostConfig.PublishAllPorts = true
+	}
+	if len(spec.Tmpfs) > 0 {
+		hostConfig.Tmpfs = spec.Tmpfs
+	}
+	hostConfig.Binds = spec.Binds
+	resp, err := c.cli.ContainerCreate(ctx, config, hostConfig, nil, nil, "")
+	if err != nil {
+		return "", fmt.Errorf("dockertest: container create: %v", err)
+	}
+	if err := c.cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		return "", fmt.Errorf("dockertest: container start: %v", err)
+	}
+	return resp.ID, nil
+}
+
+// inspect returns the full container state, including the host ports
+// actually allocated for any published container ports.
+func (c *Client) inspect(containerID string) (types.ContainerJSON, error) {
+	info, err := c.cli.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		return types.ContainerJSON{}, fmt.Errorf("dockertest: inspecting %s: %v", containerID, err)
+	}
+	return info, nil
+}
+
+func (c *Client) kill(containerID string) error {
+	if err := c.cli.ContainerKill(context.Background(), containerID, "KILL"); err != nil {
+		return fmt.Errorf("dockertest: killing %s: %v", containerID, err)
+	}
+	return nil
+}
+
+func (c *Client) remove(containerID string) error {
+	err := c.cli.ContainerRemove(context.Background(), containerID, types.ContainerRemoveOptions{Force: true})
+	if err != nil {
+		return fmt.Errorf("dockertest: removing %s: %v", containerID, err)
+	}
+	return nil
+}
@@ -1,99 +1,125 @@
 package dockertest
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"log"
-	"os/exec"
-	"strings"
+	"net"
+	"regexp"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"camlistore.org/pkg/netutil"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/go-connections/nat"
 )
 
-/// runLongTest checks all the conditions for running a docker container
-// based on image.
+var (
+	mysqlReadyPattern    = regexp.MustCompile(`ready for connections`)
+	postgresReadyPattern = regexp.MustCompile(`database system is ready to accept connections`)
+)
+
+// runLongTest checks all the conditions for running a docker container
+// based on image. Deprecated: use runLongTestE, which returns an error
+// instead of killing the test binary.
 func runLongTest(image string) {
+	if err := runLongTestE(image); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runLongTestE is runLongTest without the log.Fatal.
+func runLongTestE(image string) error {
 	if testing.Short() {
 		log.Println("skipping in short mode")
 	}
 	if !haveDocker() {
-		log.Fatal("'docker' command not found")
+		return errors.New("dockertest: docker daemon not reachable")
 	}
 	if ok, err := haveImage(image); !ok || err != nil {
 		if err != nil {
-			log.Println("Error running docker to check for %s: %v", image, err)
+			log.Printf("Error checking for image %s: %v", image, err)
 		}
 		log.Printf("Pulling docker image %s ...", image)
 		if err := Pull(image); err != nil {
-			log.Println("Error pulling %s: %v", image, err)
+			return fmt.Errorf("pulling %s: %v", image, err)
 		}
 	}
+	return nil
 }
 
-// haveDocker returns whether the "docker" command was found.
+// haveDocker returns whether a docker daemon is reachable, either via
+// the local socket or DOCKER_HOST.
 func haveDocker() bool {
-	_, err := exec.LookPath("docker")
+	c, err := defaultClientOrDial()
+	if err != nil {
+		return false
+	}
+	_, err = c.cli.Ping(context.Background())
 	return err == nil
 }
 
 func haveImage(name string) (ok bool, err error) {
-	out, err := exec.Command("docker", "images", "--no-trunc").Output()
+	c, err := defaultClientOrDial()
 	if err != nil {
-		return
-	}
-	return bytes.Contains(out, []byte(name)), nil
-}
-
-func run(args ...string) (containerID string, err error) {
-	cmd := exec.Command("docker", append([]string{"run"}, args...)...)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout, cmd.Stderr = &stdout, &stderr
-	if err = cmd.Run(); err != nil {
-		err = fmt.Errorf("%v%v", stderr.String(), err)
-		return
-	}
-	containerID = strings.TrimSpace(stdout.String())
-	if containerID == "" {
-		return "", errors.New("unexpected empty output from `docker run`")
+		return false, err
 	}
-	return
+	return c.haveImage(name)
 }
 
+// KillContainer sends SIGKILL to the given container, via the Engine API.
 func KillContainer(container string) error {
-	return exec.Command("docker", "kill", container).Run()
+	c, err := defaultClientOrDial()
+	if err != nil {
+		return err
+	}
+	return c.kill(container)
 }
 
-// Pull retrieves the docker image with 'docker pull'.
+// Pull retrieves the docker image via the Engine API, equivalent to
+// 'docker pull'.
 func Pull(image string) error {
-	out, err := exec.Command("docker", "pull", image).CombinedOutput()
+	c, err := defaultClientOrDial()
 	if err != nil {
-		err = fmt.Errorf("%v: %s", err, out)
+		return err
 	}
-	return err
-}
-
-// IP returns the IP address of the container.
-func IP(containerID string) (string, error) {
-	return "127.0.0.1", nil
+	return c.pull(image)
 }
 
 type ContainerID string
 
+// IP returns the container's address on the default bridge network.
+// Note this is only reachable from the docker host itself; to dial a
+// published port from outside the daemon's network namespace, use
+// HostPort instead.
 func (c ContainerID) IP() (string, error) {
-	return IP(string(c))
+	info, err := c.Inspect()
+	if err != nil {
+		return "", err
+	}
+	ip := info.NetworkSettings.IPAddress
+	if ip == "" {
+		return "", fmt.Errorf("dockertest: container %s has no IP address", c)
+	}
+	return ip, nil
 }
 
 func (c ContainerID) Kill() error {
 	return KillContainer(string(c))
 }
 
-// Remove runs "docker rm" on the container
+// Remove removes the container via the Engine API, equivalent to
+// 'docker rm'.
 func (c ContainerID) Remove() error {
-	return exec.Command("docker", "rm", string(c)).Run()
+	cl, err := defaultClientOrDial()
+	if err != nil {
+		return err
+	}
+	return cl.remove(string(c))
 }
 
 // KillRemove calls Kill on the container, and then Remove if there was
@@ -108,38 +134,240 @@ func (c ContainerID) KillRemove() {
 	}
 }
 
-// lookup retrieves the ip address of the container, and tries to reach
-// before timeout the tcp address at this ip and given port.
-func (c ContainerID) lookup(port int, timeout time.Duration) (ip string, err error) {
-	ip, err = c.IP()
+// Inspect returns the full container state, including the host ports
+// actually allocated for any container ports it publishes.
+func (c ContainerID) Inspect() (types.ContainerJSON, error) {
+	cl, err := defaultClientOrDial()
 	if err != nil {
-		err = fmt.Errorf("error getting IP: %v", err)
-		return
+		return types.ContainerJSON{}, err
+	}
+	return cl.inspect(string(c))
+}
+
+// HostPort returns the host and port the daemon published containerPort
+// (e.g. "5432/tcp") under. It returns an error if containerPort isn't
+// published.
+func (c ContainerID) HostPort(containerPort string) (host string, port int, err error) {
+	info, err := c.Inspect()
+	if err != nil {
+		return "", 0, err
+	}
+	bindings, ok := info.NetworkSettings.Ports[nat.Port(containerPort)]
+	if !ok || len(bindings) == 0 {
+		return "", 0, fmt.Errorf("dockertest: container port %s not published", containerPort)
+	}
+	b := bindings[0]
+	port, err = strconv.Atoi(b.HostPort)
+	if err != nil {
+		return "", 0, fmt.Errorf("dockertest: parsing host port %q: %v", b.HostPort, err)
+	}
+	host = b.HostIP
+	if host == "" || host == "0.0.0.0" {
+		host = "127.0.0.1"
+	}
+	return host, port, nil
+}
+
+// lookup awaits the host:port the daemon published containerPort (e.g.
+// "5432/tcp") under, polling until it appears, then tries to reach it
+// before timeout. It returns the reachable "host:port" address.
+func (c ContainerID) lookup(containerPort string, timeout time.Duration) (hostPort string, err error) {
+	deadline := time.Now().Add(timeout)
+	var host string
+	var port int
+	for {
+		host, port, err = c.HostPort(containerPort)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("waiting for published port: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
 	}
-	addr := fmt.Sprintf("%s:%d", ip, port)
-	err = netutil.AwaitReachable(addr, timeout)
+	hostPort = fmt.Sprintf("%s:%d", host, port)
+	err = netutil.AwaitReachable(hostPort, timeout)
 	return
 }
 
-// setupContainer sets up a container, using the start function to run the given image.
-// It also looks up the IP address of the container, and tests this address with the given
-// port and timeout. It returns the container ID and its IP address, or makes the test
-// fail on error.
-func setupContainer(image string, port int, timeout time.Duration,
-	start func() (string, error)) (c ContainerID, ip string) {
-	runLongTest(image)
+// defaultPool is dialed on first use by StartMongoContainer and friends,
+// which otherwise have no way to obtain one of their own.
+var (
+	defaultPool     *Pool
+	defaultPoolOnce sync.Once
+	defaultPoolErr  error
+)
+
+// ensureDefaultPool dials defaultPool on first use.
+func ensureDefaultPool() (*Pool, error) {
+	defaultPoolOnce.Do(func() {
+		defaultPool, defaultPoolErr = NewPool("")
+	})
+	return defaultPool, defaultPoolErr
+}
+
+// EnableReap starts a companion reaper container watching defaultPool's
+// session, the same Pool backing StartMongo, StartMySQL,
+// StartPostgreSQL and their deprecated StartXxxContainer counterparts.
+// Call it once, early, before starting any containers you want it to
+// cover. An empty image defaults to "testcontainers/ryuk:0.5.1".
+func EnableReap(image string) error {
+	p, err := ensureDefaultPool()
+	if err != nil {
+		return err
+	}
+	return p.EnableReap(image)
+}
+
+// runPool runs opts through the default Pool and blocks on wait,
+// returning an error rather than killing the test binary if any step
+// fails.
+func runPool(opts *RunOptions, wait WaitStrategy, extra ...Option) (*Resource, error) {
+	for _, opt := range extra {
+		opt(opts)
+	}
+	if _, err := ensureDefaultPool(); err != nil {
+		return nil, err
+	}
+	image := opts.Repository
+	if opts.Tag != "" {
+		image = image + ":" + opts.Tag
+	}
+	if err := runLongTestE(image); err != nil {
+		return nil, err
+	}
+	r, err := defaultPool.RunWithOptions(opts)
+	if err != nil {
+		return nil, fmt.Errorf("docker run: %v", err)
+	}
+	if err := wait.WaitUntilReady(r.Container()); err != nil {
+		defaultPool.Purge(r)
+		return nil, fmt.Errorf("container %v setup failed: %v", r.Container(), err)
+	}
+	return r, nil
+}
 
-	containerID, err := start()
+// runViaPool is the log.Fatal-based wrapper behind the deprecated
+// StartXxxContainer functions. It resolves the host:port the daemon
+// published containerPort (e.g. "27017/tcp") under; the returned ip is
+// that dial-able "host:port" address rather than a bare IP, since opts
+// publishes containerPort on a daemon-chosen host port.
+func runViaPool(opts *RunOptions, containerPort string, wait WaitStrategy, extra ...Option) (c ContainerID, ip string) {
+	r, err := runPool(opts, wait, extra...)
 	if err != nil {
 		log.Fatalf("docker run: %v", err)
 	}
-	c = ContainerID(containerID)
-	ip, err = c.lookup(port, timeout)
+	c = r.Container()
+	host, port, err := c.HostPort(containerPort)
 	if err != nil {
-		c.KillRemove()
-		log.Printf("Container %v setup failed: %v", c, err)
+		log.Fatalf("docker run: %v", err)
 	}
-	return
+	return c, fmt.Sprintf("%s:%d", host, port)
+}
+
+// StartMongo starts a real Mongo instance for testing purposes and
+// registers its teardown with t.Cleanup. An empty repository defaults
+// to "mongo"; an empty tag pulls whatever the registry resolves as
+// default (usually "latest"). Unlike StartMongoContainer, it reports
+// failure via t.Fatalf rather than killing the whole test binary.
+func StartMongo(t testing.TB, repository, tag string) (*Resource, error) {
+	t.Helper()
+	if repository == "" {
+		repository = mongoImage
+	}
+	r, err := runPool(&RunOptions{Repository: repository, Tag: tag, ExposedPorts: []string{"27017/tcp"}},
+		ForListeningPort{ContainerPort: "27017/tcp", Timeout: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("dockertest: starting mongo: %v", err)
+		return nil, err
+	}
+	t.Cleanup(func() {
+		if err := defaultPool.Purge(r); err != nil {
+			t.Logf("dockertest: purging mongo container: %v", err)
+		}
+	})
+	return r, nil
+}
+
+// StartMySQL starts a real MySQL instance for testing purposes and
+// registers its teardown with t.Cleanup. An empty repository defaults
+// to "mysql", so callers pin a reproducible build by passing a tag,
+// e.g. StartMySQL(t, "mydb", "mysql", "8.0.34"). Its data directory is
+// tmpfs-backed by default; pass WithPersistentStorage() to opt out.
+// Unlike StartMySQLContainer, it reports failure via t.Fatalf rather
+// than killing the whole test binary.
+func StartMySQL(t testing.TB, dbname, repository, tag string, opts ...Option) (*Resource, error) {
+	t.Helper()
+	if repository == "" {
+		repository = mysqlImage
+	}
+	r, err := runPool(&RunOptions{
+		Repository:   repository,
+		Tag:          tag,
+		Env:          []string{"MYSQL_ROOT_PASSWORD=" + MySQLPassword, "MYSQL_DATABASE=" + dbname},
+		ExposedPorts: []string{"3306/tcp"},
+		Tmpfs:        map[string]string{"/var/lib/mysql": ""},
+	}, ForLog{Pattern: mysqlReadyPattern, Timeout: 30 * time.Second}, opts...)
+	if err != nil {
+		t.Fatalf("dockertest: starting mysql: %v", err)
+		return nil, err
+	}
+	t.Cleanup(func() {
+		if err := defaultPool.Purge(r); err != nil {
+			t.Logf("dockertest: purging mysql container: %v", err)
+		}
+	})
+	return r, nil
+}
+
+// StartPostgreSQL starts a real PostgreSQL instance for testing purposes
+// and registers its teardown with t.Cleanup. An empty repository
+// defaults to "library/postgres", so callers pin a reproducible build
+// by passing a tag, e.g. StartPostgreSQL(t, "mydb", "library/postgres",
+// "15"). Its data directory is tmpfs-backed by default; pass
+// WithPersistentStorage() to opt out. Unlike StartPostgreSQLContainer,
+// it reports failure via t.Fatalf rather than killing the whole test
+// binary.
+func StartPostgreSQL(t testing.TB, dbname, repository, tag string, opts ...Option) (*Resource, error) {
+	t.Helper()
+	if repository == "" {
+		repository = postgresImage
+	}
+	r, err := runPool(&RunOptions{
+		Repository:   repository,
+		Tag:          tag,
+		ExposedPorts: []string{"5432/tcp"},
+		Tmpfs:        map[string]string{"/var/lib/postgresql/data": ""},
+	}, ForLog{Pattern: postgresReadyPattern, Timeout: 30 * time.Second}, opts...)
+	if err != nil {
+		t.Fatalf("dockertest: starting postgres: %v", err)
+		return nil, err
+	}
+	t.Cleanup(func() {
+		if err := defaultPool.Purge(r); err != nil {
+			t.Logf("dockertest: purging postgres container: %v", err)
+		}
+	})
+	host, port, err := r.Container().HostPort("5432/tcp")
+	if err != nil {
+		t.Fatalf("dockertest: resolving postgres port: %v", err)
+		return nil, err
+	}
+	rootdb, err := sql.Open("postgres",
+		fmt.Sprintf("user=%s password=%s host=%s port=%d dbname=postgres sslmode=disable", PostgresUsername, PostgresPassword, host, port))
+	if err != nil {
+		t.Fatalf("dockertest: opening postgres rootdb: %v", err)
+		return nil, err
+	}
+	defer rootdb.Close()
+	if err := defaultPool.Retry(func() error {
+		_, err := rootdb.Exec("CREATE DATABASE " + dbname + " LC_COLLATE = 'C' TEMPLATE = template0")
+		return err
+	}); err != nil {
+		t.Fatalf("dockertest: creating database %s: %v", dbname, err)
+		return nil, err
+	}
+	return r, nil
 }
 
 const (
@@ -152,31 +380,67 @@ const (
 	PostgresPassword = "docker" // set up by the dockerfile of postgresImage
 )
 
-// StartMongoContainer
-func StartMongoContainer() (c ContainerID, ip string) {
-	return setupContainer(mongoImage, 27017, 10*time.Second, func() (string, error) {
-		return run("-d", "-p", "27017:27017", mongoImage)
-	})
+// StartMongoContainer starts a real Mongo instance for testing purposes.
+// An empty repository defaults to "mongo"; an empty tag pulls whatever
+// the registry resolves as default (usually "latest").
+//
+// Deprecated: use StartMongo, which reports failure via t.Fatalf
+// instead of killing the whole test binary.
+func StartMongoContainer(repository, tag string) (c ContainerID, ip string) {
+	if repository == "" {
+		repository = mongoImage
+	}
+	return runViaPool(&RunOptions{Repository: repository, Tag: tag, ExposedPorts: []string{"27017/tcp"}},
+		"27017/tcp", ForListeningPort{ContainerPort: "27017/tcp", Timeout: 10 * time.Second})
 }
 
 // StartMySQLContainer sets up a real MySQL instance for testing purposes,
-func StartMySQLContainer(dbname string) (c ContainerID, ip string) {
-	return setupContainer(mysqlImage, 3306, 10*time.Second, func() (string, error) {
-		return run("-d", "-e", "MYSQL_ROOT_PASSWORD="+MySQLPassword, "-e", "MYSQL_DATABASE="+dbname, mysqlImage)
-	})
+// e.g. StartMySQLContainer(dbname, "mysql", "8.0.34"). An empty
+// repository defaults to "mysql". Its data directory is tmpfs-backed by
+// default; pass WithPersistentStorage() to opt out.
+//
+// Deprecated: use StartMySQL, which reports failure via t.Fatalf instead
+// of killing the whole test binary.
+func StartMySQLContainer(dbname, repository, tag string, opts ...Option) (c ContainerID, ip string) {
+	if repository == "" {
+		repository = mysqlImage
+	}
+	return runViaPool(&RunOptions{
+		Repository:   repository,
+		Tag:          tag,
+		Env:          []string{"MYSQL_ROOT_PASSWORD=" + MySQLPassword, "MYSQL_DATABASE=" + dbname},
+		ExposedPorts: []string{"3306/tcp"},
+		Tmpfs:        map[string]string{"/var/lib/mysql": ""},
+	}, "3306/tcp", ForLog{Pattern: mysqlReadyPattern, Timeout: 30 * time.Second}, opts...)
 }
 
-// StartPostgreSQLContainer sets up a real PostgreSQL instance for testing purposes,
-func StartPostgreSQLContainer(dbname string) (c ContainerID, ip string) {
-	c, ip = setupContainer(postgresImage, 5432, 15*time.Second, func() (string, error) {
-		return run("-d", postgresImage)
-	})
+// StartPostgreSQLContainer sets up a real PostgreSQL instance for testing
+// purposes. An empty repository defaults to "library/postgres". Its
+// data directory is tmpfs-backed by default; pass WithPersistentStorage()
+// to opt out.
+//
+// Deprecated: use StartPostgreSQL, which reports failure via t.Fatalf
+// instead of killing the whole test binary.
+func StartPostgreSQLContainer(dbname, repository, tag string, opts ...Option) (c ContainerID, ip string) {
+	if repository == "" {
+		repository = postgresImage
+	}
+	c, ip = runViaPool(&RunOptions{
+		Repository:   repository,
+		Tag:          tag,
+		ExposedPorts: []string{"5432/tcp"},
+		Tmpfs:        map[string]string{"/var/lib/postgresql/data": ""},
+	}, "5432/tcp", ForLog{Pattern: postgresReadyPattern, Timeout: 30 * time.Second}, opts...)
 	cleanupAndDie := func(err error) {
 		c.KillRemove()
 		log.Fatal(err)
 	}
+	host, port, err := net.SplitHostPort(ip)
+	if err != nil {
+		cleanupAndDie(fmt.Errorf("Could not determine published port: %v", err))
+	}
 	rootdb, err := sql.Open("postgres",
-		fmt.Sprintf("user=%s password=%s host=%s dbname=postgres sslmode=disable", PostgresUsername, PostgresPassword, ip))
+		fmt.Sprintf("user=%s password=%s host=%s port=%s dbname=postgres sslmode=disable", PostgresUsername, PostgresPassword, host, port))
 	if err != nil {
 		cleanupAndDie(fmt.Errorf("Could not open postgres rootdb: %v", err))
 	}
@@ -0,0 +1,186 @@
+package dockertest
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+)
+
+// RunOptions configures a container started through Pool.RunWithOptions.
+// Pool.Run is a convenience wrapper for the common repository/tag/env
+// case.
+type RunOptions struct {
+	Repository string
+	Tag        string
+	Env        []string
+	Cmd        []string
+	// ExposedPorts are published on the host (e.g. "5432/tcp"). Unless
+	// overridden by a matching entry in PortBindings, the daemon picks
+	// a free host port for each one, so concurrent test runs don't
+	// collide. If both ExposedPorts and PortBindings are empty, as with
+	// Pool.Run, every port the image itself exposes is published
+	// instead (equivalent to "docker run -P").
+	ExposedPorts []string
+	PortBindings map[nat.Port][]nat.PortBinding
+	// Tmpfs mounts paths inside the container on tmpfs, keyed by
+	// mount path with docker's tmpfs mount options as the value (e.g.
+	// "" or "rw,noexec,size=64m"). This speeds up throwaway database
+	// containers considerably since teardown can skip filesystem sync.
+	Tmpfs map[string]string
+}
+
+// Option customizes a RunOptions built by one of the StartXxxContainer
+// helpers.
+type Option func(*RunOptions)
+
+// WithPersistentStorage disables the tmpfs-backed data directory that
+// StartMySQLContainer and StartPostgreSQLContainer enable by default,
+// writing to the container's normal filesystem instead.
+func WithPersistentStorage() Option {
+	return func(o *RunOptions) { o.Tmpfs = nil }
+}
+
+// Pool manages containers against a single docker daemon. It is the
+// entry point for starting arbitrary images; StartMongoContainer and
+// friends are thin convenience wrappers built on top of it.
+type Pool struct {
+	client    *Client
+	sessionID string
+	reaper    *Reaper
+}
+
+// NewPool returns a Pool for the docker daemon referenced by the
+// environment (DOCKER_HOST, DOCKER_TLS_VERIFY, DOCKER_CERT_PATH), the
+// same daemon the package-level helpers use. The endpoint argument is
+// not used: a non-empty endpoint does not select a different daemon.
+func NewPool(endpoint string) (*Pool, error) {
+	c, err := newClient()
+	if err != nil {
+		return nil, err
+	}
+	return &Pool{client: c, sessionID: newSessionID()}, nil
+}
+
+// Run starts a container from repo:tag with the given environment and
+// returns a Resource for it. It is equivalent to calling
+// RunWithOptions(&RunOptions{Repository: repo, Tag: tag, Env: env}).
+func (p *Pool) Run(repo, tag string, env []string) (*Resource, error) {
+	return p.RunWithOptions(&RunOptions{Repository: repo, Tag: tag, Env: env})
+}
+
+// RunWithOptions starts a container as described by opts and returns a
+// Resource for it.
+func (p *Pool) RunWithOptions(opts *RunOptions) (*Resource, error) {
+	image := opts.Repository
+	if opts.Tag != "" {
+		image = image + ":" + opts.Tag
+	}
+	if ok, err := p.client.haveImage(image); err != nil || !ok {
+		if err := p.client.pull(image); err != nil {
+			return nil, err
+		}
+	}
+	id, err := p.client.run(runSpec{
+		Image:        image,
+		Env:          opts.Env,
+		Cmd:          opts.Cmd,
+		ExposedPorts: opts.ExposedPorts,
+		PortBindings: opts.PortBindings,
+		Tmpfs:        opts.Tmpfs,
+		Labels:       map[string]string{sessionLabel: p.sessionID},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dockertest: running %s: %v", image, err)
+	}
+	return &Resource{pool: p, container: ContainerID(id)}, nil
+}
+
+// Purge kills and removes the container backing r.
+func (p *Pool) Purge(r *Resource) error {
+	return r.Close()
+}
+
+// EnableReap starts a companion reaper container that watches for this
+// Pool's session label and removes any matching container once the
+// current process exits or its heartbeat to the reaper drops, even if
+// teardown code never runs (e.g. after log.Fatal). It is opt-in: call
+// it once, early, before starting any containers you want it to cover.
+// An empty image defaults to "testcontainers/ryuk:0.5.1".
+func (p *Pool) EnableReap(image string) error {
+	r, err := newReaper(p, image)
+	if err != nil {
+		return err
+	}
+	p.reaper = r
+	return nil
+}
+
+// Close releases resources held by the Pool, such as its reaper
+// connection, if EnableReap was called.
+func (p *Pool) Close() error {
+	if p.reaper == nil {
+		return nil
+	}
+	return p.reaper.Close()
+}
+
+// Retry calls op until it returns nil, retrying with exponential backoff
+// starting at 100ms, or until 10 seconds have elapsed. It supersedes the
+// old hard-coded sqlExecRetry, which Retry now exists alongside for
+// compatibility.
+func (p *Pool) Retry(op func() error) error {
+	interval := 100 * time.Millisecond
+	deadline := time.Now().Add(10 * time.Second)
+	var err error
+	for {
+		if err = op(); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("dockertest: giving up after retrying: %v", err)
+		}
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+// Resource represents a running container started through a Pool.
+type Resource struct {
+	pool      *Pool
+	container ContainerID
+}
+
+// Container returns the ContainerID backing the resource.
+func (r *Resource) Container() ContainerID {
+	return r.container
+}
+
+// GetPort returns the host port bound to the given container port (e.g.
+// "5432/tcp"), or "" if it isn't published.
+func (r *Resource) GetPort(containerPort string) string {
+	_, port, err := r.container.HostPort(containerPort)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d", port)
+}
+
+// GetHostPort returns "host:port" for the given container port (e.g.
+// "5432/tcp"), or "" if it isn't published.
+func (r *Resource) GetHostPort(containerPort string) string {
+	host, port, err := r.container.HostPort(containerPort)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", host, port)
+}
+
+// Close kills and removes the container. It is equivalent to
+// r.pool.Purge(r).
+func (r *Resource) Close() error {
+	if err := r.container.Kill(); err != nil {
+		return err
+	}
+	return r.container.Remove()
+}
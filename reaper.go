@@ -0,0 +1,98 @@
+package dockertest
+
+import (
+	"bufio"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"time"
+)
+
+// sessionLabel is set on every container a Pool starts. The reaper
+// watches for it so it can clean up containers left behind when a test
+// binary exits without running its deferred teardown (e.g. log.Fatal).
+const sessionLabel = "dockertest.session"
+
+// defaultReaperImage is testcontainers' ryuk, a small daemon that
+// removes docker resources matching a label filter once the TCP
+// connection that registered the filter closes.
+const defaultReaperImage = "testcontainers/ryuk:0.5.1"
+
+// Reaper watches for containers tagged with its Pool's session label
+// and removes them once the process exits or this connection drops.
+type Reaper struct {
+	container ContainerID
+	conn      net.Conn
+}
+
+// newReaper starts a ryuk container and registers pool's session label
+// with it.
+func newReaper(pool *Pool, image string) (*Reaper, error) {
+	if image == "" {
+		image = defaultReaperImage
+	}
+	if ok, err := pool.client.haveImage(image); err != nil || !ok {
+		if err := pool.client.pull(image); err != nil {
+			return nil, err
+		}
+	}
+	id, err := pool.client.run(runSpec{
+		Image:        image,
+		ExposedPorts: []string{"8080/tcp"},
+		Binds:        []string{"/var/run/docker.sock:/var/run/docker.sock"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dockertest: starting reaper: %v", err)
+	}
+	c := ContainerID(id)
+
+	deadline := time.Now().Add(10 * time.Second)
+	var conn net.Conn
+	for {
+		var host string
+		var port int
+		host, port, err = c.HostPort("8080/tcp")
+		if err == nil {
+			conn, err = net.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
+		}
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			c.KillRemove()
+			return nil, fmt.Errorf("dockertest: connecting to reaper: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if _, err := fmt.Fprintf(conn, "label=%s=%s\n", sessionLabel, pool.sessionID); err != nil {
+		conn.Close()
+		c.KillRemove()
+		return nil, fmt.Errorf("dockertest: registering reap filter: %v", err)
+	}
+	ack, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || ack != "ACK\n" {
+		conn.Close()
+		c.KillRemove()
+		return nil, fmt.Errorf("dockertest: reaper did not acknowledge filter: %q, %v", ack, err)
+	}
+
+	return &Reaper{container: c, conn: conn}, nil
+}
+
+// Close drops the connection that registered this session's reap
+// filter, signaling the reaper to remove every container tagged with
+// it.
+func (r *Reaper) Close() error {
+	return r.conn.Close()
+}
+
+// newSessionID returns a random hex string identifying one Pool's
+// containers to the reaper.
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("dockertest: reading random bytes: " + err.Error())
+	}
+	return fmt.Sprintf("%x", b)
+}
@@ -0,0 +1,186 @@
+package dockertest
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// WaitStrategy determines when a freshly started container is ready to
+// accept traffic. ForListeningPort merely checks that a TCP port is
+// open, which is often too weak a signal for databases that accept
+// connections before they accept queries; the other strategies probe
+// deeper.
+type WaitStrategy interface {
+	// WaitUntilReady blocks until c is ready, or returns an error if
+	// it never becomes so.
+	WaitUntilReady(c ContainerID) error
+}
+
+// ForListeningPort waits until containerPort (e.g. "5432/tcp") is
+// published and accepting TCP connections.
+type ForListeningPort struct {
+	ContainerPort string
+	Timeout       time.Duration
+}
+
+// WaitUntilReady implements WaitStrategy.
+func (w ForListeningPort) WaitUntilReady(c ContainerID) error {
+	_, err := c.lookup(w.ContainerPort, w.Timeout)
+	return err
+}
+
+// ForLog waits until a line matching Pattern appears in the container's
+// logs, e.g. "ready for connections" for MySQL or "database system is
+// ready to accept connections" for Postgres.
+type ForLog struct {
+	Pattern *regexp.Regexp
+	Timeout time.Duration
+}
+
+// WaitUntilReady implements WaitStrategy.
+func (w ForLog) WaitUntilReady(c ContainerID) error {
+	cl, err := defaultClientOrDial()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), w.Timeout)
+	defer cancel()
+	rc, err := cl.cli.ContainerLogs(ctx, string(c), types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Follow: true})
+	if err != nil {
+		return fmt.Errorf("dockertest: streaming logs: %v", err)
+	}
+	defer rc.Close()
+	scanner := bufio.NewScanner(rc)
+	for scanner.Scan() {
+		if w.Pattern.MatchString(scanner.Text()) {
+			return nil
+		}
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("dockertest: timed out waiting for log pattern %q", w.Pattern)
+	}
+	return fmt.Errorf("dockertest: log stream ended before pattern %q appeared", w.Pattern)
+}
+
+// ForHTTP waits until an HTTP GET against containerPort's published
+// host:port and path returns StatusCode.
+type ForHTTP struct {
+	ContainerPort string
+	Path          string
+	StatusCode    int
+	Timeout       time.Duration
+}
+
+// WaitUntilReady implements WaitStrategy.
+func (w ForHTTP) WaitUntilReady(c ContainerID) error {
+	deadline := time.Now().Add(w.Timeout)
+	var lastErr error
+	for {
+		host, port, err := c.HostPort(w.ContainerPort)
+		if err == nil {
+			var resp *http.Response
+			resp, err = http.Get(fmt.Sprintf("http://%s:%d%s", host, port, w.Path))
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode == w.StatusCode {
+					return nil
+				}
+				err = fmt.Errorf("got status %d, want %d", resp.StatusCode, w.StatusCode)
+			}
+		}
+		lastErr = err
+		if time.Now().After(deadline) {
+			return fmt.Errorf("dockertest: timed out waiting for HTTP readiness: %v", lastErr)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// ForSQL waits until a *sql.DB opened with Driver and the DSN returned
+// by DSN (given the container's published "host:port" for
+// ContainerPort) responds to Ping. This is the probe MySQL and
+// Postgres need, since both accept TCP well before they accept auth.
+type ForSQL struct {
+	ContainerPort string
+	Driver        string
+	DSN           func(hostPort string) string
+	Timeout       time.Duration
+}
+
+// WaitUntilReady implements WaitStrategy.
+func (w ForSQL) WaitUntilReady(c ContainerID) error {
+	deadline := time.Now().Add(w.Timeout)
+	var lastErr error
+	for {
+		host, port, err := c.HostPort(w.ContainerPort)
+		if err == nil {
+			var db *sql.DB
+			db, err = sql.Open(w.Driver, w.DSN(fmt.Sprintf("%s:%d", host, port)))
+			if err == nil {
+				err = db.Ping()
+				db.Close()
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if time.Now().After(deadline) {
+			return fmt.Errorf("dockertest: timed out waiting for SQL readiness: %v", lastErr)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// ForExec waits until running Cmd inside the container exits with
+// ExitCode.
+type ForExec struct {
+	Cmd      []string
+	ExitCode int
+	Timeout  time.Duration
+}
+
+// WaitUntilReady implements WaitStrategy.
+func (w ForExec) WaitUntilReady(c ContainerID) error {
+	cl, err := defaultClientOrDial()
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(w.Timeout)
+	var lastErr error
+	for {
+		ctx := context.Background()
+		exec, err := cl.cli.ContainerExecCreate(ctx, string(c), types.ExecConfig{Cmd: w.Cmd})
+		if err == nil {
+			if err = cl.cli.ContainerExecStart(ctx, exec.ID, types.ExecStartCheck{}); err == nil {
+				var inspect types.ContainerExecInspect
+				inspect, err = cl.cli.ContainerExecInspect(ctx, exec.ID)
+				for err == nil && inspect.Running && time.Now().Before(deadline) {
+					time.Sleep(50 * time.Millisecond)
+					inspect, err = cl.cli.ContainerExecInspect(ctx, exec.ID)
+				}
+				if err == nil {
+					if inspect.Running {
+						err = fmt.Errorf("exec still running")
+					} else if inspect.ExitCode == w.ExitCode {
+						return nil
+					} else {
+						err = fmt.Errorf("exec exited %d, want %d", inspect.ExitCode, w.ExitCode)
+					}
+				}
+			}
+		}
+		lastErr = err
+		if time.Now().After(deadline) {
+			return fmt.Errorf("dockertest: timed out waiting for exec readiness: %v", lastErr)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}